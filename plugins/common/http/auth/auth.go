@@ -0,0 +1,327 @@
+// Package auth builds an *http.Client for one of the authentication modes
+// an HTTP-based plugin can be configured with: HTTP Basic, a file-watched
+// bearer token, OAuth2 client-credentials with a token cache, or mutual
+// TLS with certificate rotation.
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// Mode selects which entry of Config is used to authenticate outgoing
+// requests. The zero value, ModeNone, performs no authentication.
+type Mode string
+
+const (
+	ModeNone   Mode = ""
+	ModeBasic  Mode = "basic"
+	ModeBearer Mode = "bearer"
+	ModeOAuth2 Mode = "oauth2"
+	ModeMTLS   Mode = "mtls"
+)
+
+// Config describes how to authenticate, covering the fields needed by every
+// mode; only the fields relevant to the selected Mode are read.
+type Config struct {
+	Mode Mode
+
+	// ModeBasic
+	Username string
+	Password string
+
+	// ModeBearer. BearerTokenFile is re-read on every request so a token
+	// rotated on disk takes effect without a plugin restart.
+	BearerTokenFile string
+
+	// ModeOAuth2
+	ClientID     string
+	ClientSecret string
+	TokenURL     string
+	Scopes       []string
+	// TokenCacheDir persists the access token to disk across restarts, keyed
+	// by ClientID+TokenURL, so a restart doesn't force a fresh
+	// client-credentials exchange. Empty disables only the on-disk
+	// persistence; the token is still cached in memory and still
+	// invalidated and re-fetched on a 401, see cachingTokenSource.
+	TokenCacheDir string
+
+	// ModeMTLS relies on the client's TLSClientConfig already carrying
+	// GetClientCertificate for rotation; NewClient returns the supplied
+	// client unchanged and does not check that it carries a certificate.
+}
+
+// NewClient returns base wrapped with a RoundTripper implementing the
+// configured Mode. base should already carry TLS settings (including, for
+// ModeMTLS, a GetClientCertificate callback for cert rotation).
+func (c Config) NewClient(ctx context.Context, base *http.Client) (*http.Client, error) {
+	switch c.Mode {
+	case ModeNone, ModeMTLS:
+		return base, nil
+	case ModeBasic:
+		if c.Username == "" && c.Password == "" {
+			return nil, fmt.Errorf("auth_mode %q requires username or password", c.Mode)
+		}
+		return &http.Client{
+			Transport: &basicRoundTripper{base: base.Transport, username: c.Username, password: c.Password},
+			Timeout:   base.Timeout,
+		}, nil
+	case ModeBearer:
+		if c.BearerTokenFile == "" {
+			return nil, fmt.Errorf("auth_mode %q requires bearer_token_file", c.Mode)
+		}
+		return &http.Client{
+			Transport: &bearerRoundTripper{base: base.Transport, tokenFile: c.BearerTokenFile},
+			Timeout:   base.Timeout,
+		}, nil
+	case ModeOAuth2:
+		return c.newOAuth2Client(ctx, base)
+	default:
+		return nil, fmt.Errorf("unknown auth_mode %q", c.Mode)
+	}
+}
+
+func (c Config) newOAuth2Client(ctx context.Context, base *http.Client) (*http.Client, error) {
+	if c.ClientID == "" || c.ClientSecret == "" || c.TokenURL == "" {
+		return nil, fmt.Errorf("auth_mode %q requires client_id, client_secret and token_url", c.Mode)
+	}
+
+	oauthConfig := clientcredentials.Config{
+		ClientID:     c.ClientID,
+		ClientSecret: c.ClientSecret,
+		TokenURL:     c.TokenURL,
+		Scopes:       c.Scopes,
+	}
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, base)
+
+	// newSource builds a fresh oauthConfig.TokenSource on demand. That call
+	// returns an oauth2.ReuseTokenSource, which does its own not-yet-expired
+	// caching underneath cachingTokenSource's -- so invalidating only
+	// cachingTokenSource's own token and asking the *same* wrapped source
+	// for another one would just hand back the stale token again. Rebuilding
+	// wrapped from scratch is what actually forces the next Token() call
+	// back to TokenURL.
+	newSource := func() oauth2.TokenSource { return oauthConfig.TokenSource(ctx) }
+
+	// cache always sits between the oauth2 transport and the underlying
+	// client-credentials source: it holds the current token in memory so
+	// unauthorizedRetryRoundTripper can invalidate it on a 401 regardless of
+	// whether on-disk persistence (TokenCacheDir) is configured.
+	cache := &cachingTokenSource{newSource: newSource, wrapped: newSource()}
+	if c.TokenCacheDir != "" {
+		cache.path = tokenCachePath(c.TokenCacheDir, c.ClientID, c.TokenURL)
+	}
+
+	return &http.Client{
+		Transport: &unauthorizedRetryRoundTripper{
+			base:  &oauth2.Transport{Source: cache, Base: base.Transport},
+			cache: cache,
+		},
+		Timeout: base.Timeout,
+	}, nil
+}
+
+// unauthorizedRetryRoundTripper retries a request exactly once, after
+// invalidating any cached token, when the server responds 401. A cached
+// token can look unexpired locally while the server has already revoked it
+// (clock skew, manual revocation), so the cache alone can't be trusted to
+// notice.
+type unauthorizedRetryRoundTripper struct {
+	base  http.RoundTripper
+	cache *cachingTokenSource
+}
+
+func (rt *unauthorizedRetryRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	bodyBytes, err := cloneBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := rt.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	rt.cache.invalidate()
+	req, err = resetBody(req, bodyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return rt.base.RoundTrip(req)
+}
+
+func tokenCachePath(dir, clientID, tokenURL string) string {
+	sum := sha256.Sum256([]byte(clientID + "|" + tokenURL))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// cachingTokenSource holds the token from wrapped in memory, and on disk too
+// when path is set, so a restart doesn't force a fresh client-credentials
+// exchange. path empty disables only the disk persistence: the in-memory
+// cache (and therefore invalidate) still works, which is what lets a 401
+// force reauthentication even when TokenCacheDir is unset.
+//
+// newSource rebuilds wrapped from scratch; see invalidate for why that's
+// necessary rather than just re-calling wrapped.Token().
+type cachingTokenSource struct {
+	newSource func() oauth2.TokenSource
+	wrapped   oauth2.TokenSource
+	path      string
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+func (c *cachingTokenSource) Token() (*oauth2.Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token == nil {
+		c.token = c.readCache()
+	}
+	if c.token.Valid() {
+		return c.token, nil
+	}
+
+	token, err := c.wrapped.Token()
+	if err != nil {
+		return nil, err
+	}
+	c.token = token
+	c.writeCache(token)
+
+	return token, nil
+}
+
+// invalidate drops the in-memory token, rebuilds wrapped so its own
+// not-yet-expired cache can't hand the same token back, and removes the
+// on-disk copy when path is set -- so the next Token() call is forced all
+// the way back to TokenURL.
+func (c *cachingTokenSource) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.token = nil
+	c.wrapped = c.newSource()
+	if c.path != "" {
+		os.Remove(c.path)
+	}
+}
+
+func (c *cachingTokenSource) readCache() *oauth2.Token {
+	if c.path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return nil
+	}
+
+	var token oauth2.Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil
+	}
+
+	return &token
+}
+
+func (c *cachingTokenSource) writeCache(token *oauth2.Token) {
+	if c.path == "" {
+		return
+	}
+
+	data, err := json.Marshal(token)
+	if err != nil {
+		return
+	}
+
+	_ = os.MkdirAll(filepath.Dir(c.path), 0700)
+	_ = ioutil.WriteFile(c.path, data, 0600)
+}
+
+// basicRoundTripper sets HTTP Basic Auth on every outgoing request.
+type basicRoundTripper struct {
+	base               http.RoundTripper
+	username, password string
+}
+
+func (rt *basicRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(rt.username, rt.password)
+	return transport(rt.base).RoundTrip(req)
+}
+
+// bearerRoundTripper sets an Authorization: Bearer header read fresh from
+// tokenFile on every request, so a token rotated on disk is picked up
+// without a plugin restart.
+type bearerRoundTripper struct {
+	base      http.RoundTripper
+	tokenFile string
+}
+
+func (rt *bearerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := ioutil.ReadFile(rt.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading bearer_token_file: %w", err)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	return transport(rt.base).RoundTrip(req)
+}
+
+// cloneBody reads req.Body into memory (if any) so it can be replayed by
+// resetBody on retry; the original RoundTrip consumes it.
+func cloneBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	data, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return data, nil
+}
+
+// resetBody gives req a fresh, unread copy of bodyBytes for a retry.
+func resetBody(req *http.Request, bodyBytes []byte) (*http.Request, error) {
+	if bodyBytes == nil {
+		return req, nil
+	}
+	req = req.Clone(req.Context())
+	req.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+	return req, nil
+}
+
+func transport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		return http.DefaultTransport
+	}
+	return rt
+}
+
+// basicAuthHeader is a small helper used by tests to assert on the header a
+// basicRoundTripper produces without standing up a real request.
+func basicAuthHeader(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestOAuth2RetriesAfterUnauthorized exercises token fetch -> request ->
+// 401 -> token refresh -> retry -> 200 against a fake OAuth2 token endpoint
+// and a fake resource endpoint that rejects the first issued token.
+func TestOAuth2RetriesAfterUnauthorized(t *testing.T) {
+	var tokensIssued int32
+	var resourceRequests int32
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&tokensIssued, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token-` + strconv.Itoa(int(n)) + `","token_type":"bearer","expires_in":3600}`))
+	}))
+	defer tokenServer.Close()
+
+	resourceServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&resourceRequests, 1)
+		if n == 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer resourceServer.Close()
+
+	cfg := Config{
+		Mode:         ModeOAuth2,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		TokenURL:     tokenServer.URL,
+	}
+
+	client, err := cfg.NewClient(context.Background(), &http.Client{})
+	require.NoError(t, err)
+
+	resp, err := client.Get(resourceServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, int32(2), resourceRequests)
+	require.Equal(t, int32(2), tokensIssued)
+}
+
+func TestBasicAuthRoundTripperSetsHeader(t *testing.T) {
+	var gotAuth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	cfg := Config{Mode: ModeBasic, Username: "user", Password: "pass"}
+	client, err := cfg.NewClient(context.Background(), &http.Client{})
+	require.NoError(t, err)
+
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.Equal(t, basicAuthHeader("user", "pass"), gotAuth)
+}
@@ -0,0 +1,283 @@
+// Package configpatch applies server-delivered input plugin configuration
+// to an existing telegraf.conf by splicing the raw text of its [[inputs.*]]
+// tables rather than rewriting the file line by line between comment
+// markers -- or reparsing and reserializing the whole document, which would
+// drop every comment telegraf.conf has outside those tables.
+package configpatch
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	toml "github.com/pelletier/go-toml"
+
+	"github.com/influxdata/telegraf/agent"
+	"github.com/influxdata/telegraf/internal/config"
+)
+
+// MaxBackups is the number of rotated telegraf.conf.bak.N files kept on disk.
+const MaxBackups = 5
+
+// ValidationError wraps a failure of the merged config to pass the same
+// validation telegraf runs at startup. It is returned instead of a plain
+// error so callers can tell "the patch itself couldn't be applied" (an I/O
+// or parse failure, which should propagate) apart from "the patch applied
+// but produced a config telegraf would refuse to load" (which a caller may
+// choose to treat as a rejected update instead of a fatal error).
+type ValidationError struct {
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Patcher splices input plugin tables into an on-disk telegraf.conf,
+// validating the result before it is allowed to replace the original.
+type Patcher struct {
+	// ConfigFilePath is the directory containing telegraf.conf.
+	ConfigFilePath string
+}
+
+// New returns a Patcher rooted at configFilePath.
+func New(configFilePath string) *Patcher {
+	return &Patcher{ConfigFilePath: configFilePath}
+}
+
+func (p *Patcher) configPath() string {
+	return filepath.Join(p.ConfigFilePath, "telegraf.conf")
+}
+
+// Apply splices the server-delivered pluginTOML fragment's top-level input
+// plugin tables into the existing telegraf.conf by name, byte range by byte
+// range, leaving every line of the file outside a replaced table -- global
+// settings, [[outputs.*]] plugins, comments anywhere -- untouched. The
+// fragment may describe a single plugin (a partial update) or several.
+//
+// The merged config is validated with config.NewConfig().LoadConfig before
+// it is allowed to replace telegraf.conf. If validation fails, the original
+// file is left in place and a *ValidationError is returned; any other error
+// (reading telegraf.conf, parsing the fragment, disk I/O) is returned as a
+// plain error, not a *ValidationError, so callers don't mistake an
+// infrastructure failure for a rejected config. On success the previous telegraf.conf is rotated into
+// telegraf.conf.bak.N so a failed restart can be rolled back by hand.
+func (p *Patcher) Apply(pluginTOML string) error {
+	if pluginTOML == "" {
+		return nil
+	}
+
+	original, err := ioutil.ReadFile(p.configPath())
+	if err != nil {
+		return err
+	}
+
+	if _, err := toml.Load(pluginTOML); err != nil {
+		return fmt.Errorf("configpatch: parsing plugin config: %w", err)
+	}
+
+	merged, err := spliceInputTables(string(original), pluginTOML)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := p.configPath() + ".new"
+	if err := ioutil.WriteFile(tmpPath, []byte(merged), 0644); err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	if err := validate(tmpPath); err != nil {
+		return &ValidationError{Err: err}
+	}
+
+	if err := p.rotateBackups(original); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, p.configPath())
+}
+
+// inputTableHeader matches a TOML table header under the inputs.*
+// namespace -- e.g. "[[inputs.cpu]]" or "  [inputs.cpu.tags]" -- capturing
+// the plugin name, the path segment right after "inputs.".
+var inputTableHeader = regexp.MustCompile(`^\s*\[{1,2}\s*inputs\.([A-Za-z0-9_]+)(?:[.\]]|$)`)
+
+// tableHeader matches any TOML table header line, used to find where an
+// inputs.<name> block ends: the next header that isn't itself part of the
+// same plugin's block.
+var tableHeader = regexp.MustCompile(`^\s*\[{1,2}[^\[\]]+\]{1,2}\s*(#.*)?\s*$`)
+
+// spliceInputTables replaces every existing [[inputs.<name>]] block (plus
+// any of its own nested tables, such as a trailing [inputs.<name>.tags])
+// named in fragment with that plugin's text from fragment, appends plugin
+// names from fragment that don't exist in original yet, and leaves every
+// other line of original exactly as it was.
+func spliceInputTables(original, fragment string) (string, error) {
+	groups, order, err := groupFragmentByPlugin(fragment)
+	if err != nil {
+		return "", err
+	}
+
+	lines := strings.Split(original, "\n")
+	replaced := make(map[string]bool, len(groups))
+	out := make([]string, 0, len(lines))
+
+	for i := 0; i < len(lines); {
+		m := inputTableHeader.FindStringSubmatch(lines[i])
+		name := ""
+		if m != nil {
+			name = m[1]
+		}
+
+		fragmentText, isReplaced := groups[name]
+		if name == "" || !isReplaced {
+			out = append(out, lines[i])
+			i++
+			continue
+		}
+
+		if !replaced[name] {
+			out = append(out, strings.TrimRight(fragmentText, "\n"))
+			replaced[name] = true
+		}
+		i = consumeInputBlock(lines, i, name)
+	}
+
+	merged := strings.Join(out, "\n")
+
+	var appended []string
+	for _, name := range order {
+		if !replaced[name] {
+			appended = append(appended, strings.TrimRight(groups[name], "\n"))
+		}
+	}
+	if len(appended) > 0 {
+		if !strings.HasSuffix(merged, "\n") {
+			merged += "\n"
+		}
+		merged += strings.Join(appended, "\n") + "\n"
+	}
+
+	return merged, nil
+}
+
+// consumeInputBlock returns the index just past the run of lines, starting
+// at start, that belong to the inputs.<name> block: start itself plus every
+// following line up to (but not including) the next header for a different
+// table.
+func consumeInputBlock(lines []string, start int, name string) int {
+	i := start + 1
+	for i < len(lines) {
+		if tableHeader.MatchString(lines[i]) {
+			if m := inputTableHeader.FindStringSubmatch(lines[i]); m != nil && m[1] == name {
+				i++
+				continue
+			}
+			break
+		}
+		i++
+	}
+	return i
+}
+
+// groupFragmentByPlugin splits a multi-plugin TOML fragment into one text
+// block per top-level inputs.<name>, in first-seen order, so each can be
+// spliced into (or appended to) the base config independently.
+func groupFragmentByPlugin(fragment string) (groups map[string]string, order []string, err error) {
+	lines := strings.Split(fragment, "\n")
+	builders := map[string]*strings.Builder{}
+	current := ""
+
+	for _, line := range lines {
+		if m := inputTableHeader.FindStringSubmatch(line); m != nil {
+			current = m[1]
+			if _, ok := builders[current]; !ok {
+				builders[current] = &strings.Builder{}
+				order = append(order, current)
+			}
+		} else if current == "" {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			return nil, nil, fmt.Errorf("configpatch: plugin config must contain only [inputs.*] tables")
+		}
+		builders[current].WriteString(line)
+		builders[current].WriteString("\n")
+	}
+
+	if len(order) == 0 {
+		return nil, nil, fmt.Errorf("configpatch: plugin config has no [inputs.*] tables")
+	}
+
+	groups = make(map[string]string, len(builders))
+	for name, b := range builders {
+		groups[name] = b.String()
+	}
+	return groups, order, nil
+}
+
+// validate loads cfgPath the same way the agent does at startup, so a
+// splice that produces an unparsable or semantically invalid config is
+// rejected before it ever reaches telegraf.conf.
+func validate(cfgPath string) error {
+	c := config.NewConfig()
+	if err := c.LoadConfig(cfgPath); err != nil {
+		return err
+	}
+
+	ag, err := agent.NewAgent(c)
+	if err != nil {
+		return err
+	}
+
+	testContext, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	return ag.Test(testContext, 0)
+}
+
+// rotateBackups shifts telegraf.conf.bak.N to telegraf.conf.bak.N+1 (dropping
+// anything past MaxBackups) and writes the pre-patch config out as
+// telegraf.conf.bak.0.
+func (p *Patcher) rotateBackups(previous []byte) error {
+	for n := MaxBackups - 1; n >= 0; n-- {
+		src := p.backupPath(n)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		if n+1 >= MaxBackups {
+			if err := os.Remove(src); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.Rename(src, p.backupPath(n+1)); err != nil {
+			return err
+		}
+	}
+
+	return ioutil.WriteFile(p.backupPath(0), previous, 0644)
+}
+
+func (p *Patcher) backupPath(n int) string {
+	return p.configPath() + ".bak." + strconv.Itoa(n)
+}
+
+// backups returns the rotated backup paths that currently exist, ordered
+// most-recent-first (bak.0 is the most recent pre-patch state).
+func (p *Patcher) backups() []string {
+	matches, _ := filepath.Glob(p.configPath() + ".bak.*")
+	sort.Strings(matches)
+	return matches
+}
@@ -0,0 +1,97 @@
+package configpatch
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotateBackupsShiftsAndCaps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configpatch")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p := New(dir)
+	require.NoError(t, ioutil.WriteFile(p.backupPath(0), []byte("oldest-kept"), 0644))
+	require.NoError(t, ioutil.WriteFile(p.backupPath(MaxBackups-1), []byte("about-to-drop"), 0644))
+
+	require.NoError(t, p.rotateBackups([]byte("newest")))
+
+	got, err := ioutil.ReadFile(p.backupPath(0))
+	require.NoError(t, err)
+	require.Equal(t, "newest", string(got))
+
+	got, err = ioutil.ReadFile(p.backupPath(1))
+	require.NoError(t, err)
+	require.Equal(t, "oldest-kept", string(got))
+
+	_, err = os.Stat(p.backupPath(MaxBackups))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestValidationErrorUnwraps(t *testing.T) {
+	inner := errors.New("boom")
+	err := &ValidationError{Err: inner}
+
+	require.Equal(t, "boom", err.Error())
+	require.Equal(t, inner, errors.Unwrap(err))
+}
+
+func TestSpliceInputTablesPreservesCommentsOutsidePatchedTables(t *testing.T) {
+	original := "# Global agent config\n" +
+		"[agent]\n" +
+		"  interval = \"10s\" # flush interval\n" +
+		"\n" +
+		"# Input plugins below\n" +
+		"[[inputs.cpu]]\n" +
+		"  percpu = true\n"
+
+	merged, err := spliceInputTables(original, "[[inputs.cpu]]\n  percpu = false\n")
+	require.NoError(t, err)
+
+	require.Contains(t, merged, "# Global agent config")
+	require.Contains(t, merged, "interval = \"10s\" # flush interval")
+	require.Contains(t, merged, "# Input plugins below")
+	require.Contains(t, merged, "percpu = false")
+	require.NotContains(t, merged, "percpu = true")
+}
+
+func TestSpliceInputTablesAppendsNewPlugin(t *testing.T) {
+	original := "[agent]\n  interval = \"10s\"\n\n[[inputs.cpu]]\n  percpu = true\n"
+
+	merged, err := spliceInputTables(original, "[[inputs.mem]]\n")
+	require.NoError(t, err)
+
+	require.Contains(t, merged, "percpu = true")
+	require.Contains(t, merged, "[[inputs.mem]]")
+}
+
+func TestSpliceInputTablesReplacesOnlyNamedPlugin(t *testing.T) {
+	original := "[[inputs.cpu]]\n  percpu = true\n\n[[inputs.mem]]\n"
+
+	merged, err := spliceInputTables(original, "[[inputs.cpu]]\n  percpu = false\n")
+	require.NoError(t, err)
+
+	require.Contains(t, merged, "percpu = false")
+	require.Contains(t, merged, "[[inputs.mem]]")
+	require.NotContains(t, merged, "percpu = true")
+}
+
+func TestSpliceInputTablesKeepsNestedSubtableWithReplacedBlock(t *testing.T) {
+	original := "[[inputs.win_perf_counters]]\n" +
+		"  use_wildcards_expansion = true\n" +
+		"[inputs.win_perf_counters.tags]\n" +
+		"  role = \"old\"\n" +
+		"\n" +
+		"[[inputs.mem]]\n"
+
+	merged, err := spliceInputTables(original, "[[inputs.win_perf_counters]]\n[inputs.win_perf_counters.tags]\n  role = \"new\"\n")
+	require.NoError(t, err)
+
+	require.Contains(t, merged, "role = \"new\"")
+	require.NotContains(t, merged, "role = \"old\"")
+	require.Contains(t, merged, "[[inputs.mem]]")
+}
@@ -4,30 +4,40 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"crypto/md5"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/influxdata/telegraf/agent"
-	"github.com/influxdata/telegraf/internal/config"
 	"github.com/kardianos/osext"
 	"io"
 	"io/ioutil"
-	"log"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/rs/zerolog"
+
 	"github.com/influxdata/telegraf"
 	"github.com/influxdata/telegraf/internal"
 	httpconfig "github.com/influxdata/telegraf/plugins/common/http"
+	"github.com/influxdata/telegraf/plugins/common/http/auth"
+	"github.com/influxdata/telegraf/plugins/inputs"
 	"github.com/influxdata/telegraf/plugins/outputs"
+	"github.com/influxdata/telegraf/plugins/outputs/http/configpatch"
 	"github.com/influxdata/telegraf/plugins/serializers"
+	"github.com/influxdata/telegraf/plugins/serializers/tomlfragment"
 )
 
 const (
@@ -51,12 +61,26 @@ var sampleConfig = `
   # username = "username"
   # password = "pa$$word"
 
+  ## auth_mode selects how requests are authenticated: "basic", "bearer",
+  ## "oauth2" or "mtls". Leave unset to authenticate the way username/
+  ## password or the OAuth2 fields below already imply.
+  # auth_mode = ""
+
+  ## bearer_token_file is re-read on every request, so a token rotated on
+  ## disk takes effect without restarting telegraf. Used when auth_mode
+  ## is "bearer".
+  # bearer_token_file = "/etc/telegraf/bearer-token"
+
   ## OAuth2 Client Credentials Grant
   # client_id = "clientid"
   # client_secret = "secret"
   # token_url = "https://indentityprovider/oauth2/v1/token"
   # scopes = ["urn:opc:idm:__myscopes__"]
 
+  ## token_cache_dir persists the OAuth2 access token across restarts so a
+  ## restart doesn't force a fresh client-credentials exchange.
+  # token_cache_dir = "/var/run/telegraf"
+
   ## Optional TLS Config
   # tls_ca = "/etc/telegraf/ca.pem"
   # tls_cert = "/etc/telegraf/cert.pem"
@@ -83,59 +107,108 @@ var sampleConfig = `
   ## Maximum amount of time before idle connection is closed.
   ## Zero means no limit.
   # idle_conn_timeout = 0
+
+  ## Hex-encoded Ed25519 public key(s) used to verify the signed update
+  ## manifest served at url+"Update/manifest" before an auto-update binary
+  ## is trusted. update_public_keys allows a second, rotated key to be
+  ## accepted alongside update_public_key during a key rollover.
+  # update_public_key = ""
+  # update_public_keys = []
+
+  ## Retry policy for a failed write. Full-jitter exponential backoff is used
+  ## between attempts, honoring a Retry-After header on 429/503 responses.
+  # max_retries = 3
+  # initial_backoff = "500ms"
+  # max_backoff = "30s"
+  # retry_on_status = [429, 502, 503, 504]
+
+  ## After a write fails, further writes to this url are skipped until
+  ## breaker_cooldown has passed, at which point a single probe write is
+  ## allowed through to test whether the bridge has recovered.
+  # breaker_cooldown = "30s"
 `
 
 const (
 	defaultClientTimeout = 5 * time.Second
 	defaultContentType   = "text/plain; charset=utf-8"
 	defaultMethod        = http.MethodPost
+
+	defaultMaxRetries      = 3
+	defaultInitialBackoff  = 500 * time.Millisecond
+	defaultMaxBackoff      = 30 * time.Second
+	defaultBreakerCooldown = 30 * time.Second
 )
 
+// defaultRetryOnStatus is used when retry_on_status is unset.
+var defaultRetryOnStatus = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
 type HTTP struct {
-	URL             string            `toml:"url"`
-	Method          string            `toml:"method"`
-	Username        string            `toml:"username"`
-	Password        string            `toml:"password"`
-	Headers         map[string]string `toml:"headers"`
-	ContentEncoding string            `toml:"content_encoding"`
-	SourceAddress   string            `toml:"source_address"`
-	ConfigFilePath  string            `toml:"config_file_path"`
+	URL              string            `toml:"url"`
+	Method           string            `toml:"method"`
+	Username         string            `toml:"username"`
+	Password         string            `toml:"password"`
+	Headers          map[string]string `toml:"headers"`
+	ContentEncoding  string            `toml:"content_encoding"`
+	SourceAddress    string            `toml:"source_address"`
+	ConfigFilePath   string            `toml:"config_file_path"`
+	UpdatePublicKey  string            `toml:"update_public_key"`
+	UpdatePublicKeys []string          `toml:"update_public_keys"`
+	AuthMode         string            `toml:"auth_mode"`
+	BearerTokenFile  string            `toml:"bearer_token_file"`
+	TokenCacheDir    string            `toml:"token_cache_dir"`
+
+	MaxRetries      int               `toml:"max_retries"`
+	InitialBackoff  internal.Duration `toml:"initial_backoff"`
+	MaxBackoff      internal.Duration `toml:"max_backoff"`
+	RetryOnStatus   []int             `toml:"retry_on_status"`
+	BreakerCooldown internal.Duration `toml:"breaker_cooldown"`
+
 	httpconfig.HTTPClientConfig
 
 	client     *http.Client
 	serializer serializers.Serializer
 }
 
+// Logger is the package-level zerolog hook used by every HTTP instance.
+// It defaults to timestamped JSON lines on stderr, so events below are
+// parseable by a fleet-wide log collector; main.go can swap it for a logger
+// with a different writer or level.
+var Logger = zerolog.New(os.Stderr).With().Timestamp().Logger()
+
+// logger returns a Logger scoped to this plugin instance's current state.
+func (h *HTTP) logger() zerolog.Logger {
+	return Logger.With().
+		Str("url", h.URL).
+		Str("revision", revision).
+		Str("source", h.SourceAddress).
+		Int("config_error_code", configErrorCode).
+		Logger()
+}
+
 func (h *HTTP) SetSerializer(serializer serializers.Serializer) {
 	h.serializer = serializer
 }
 
-func (h *HTTP) createClient(ctx context.Context) (*http.Client, error) {
-	tlsCfg, err := h.ClientConfig.TLSConfig()
-	if err != nil {
-		return nil, err
-	}
-
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: tlsCfg,
-			Proxy:           http.ProxyFromEnvironment,
-		},
-		Timeout: h.Timeout.Duration,
+// authConfig translates the plugin's TOML options into an auth.Config for
+// the configured AuthMode. ModeNone/ModeMTLS are handled entirely by
+// HTTPClientConfig.CreateClient's TLS setup, so they need nothing here.
+func (h *HTTP) authConfig() auth.Config {
+	return auth.Config{
+		Mode:            auth.Mode(h.AuthMode),
+		Username:        h.Username,
+		Password:        h.Password,
+		BearerTokenFile: h.BearerTokenFile,
+		ClientID:        h.ClientID,
+		ClientSecret:    h.ClientSecret,
+		TokenURL:        h.TokenURL,
+		Scopes:          h.Scopes,
+		TokenCacheDir:   h.TokenCacheDir,
 	}
-
-	if h.ClientID != "" && h.ClientSecret != "" && h.TokenURL != "" {
-		oauthConfig := clientcredentials.Config{
-			ClientID:     h.ClientID,
-			ClientSecret: h.ClientSecret,
-			TokenURL:     h.TokenURL,
-			Scopes:       h.Scopes,
-		}
-		ctx = context.WithValue(ctx, oauth2.HTTPClient, client)
-		client = oauthConfig.Client(ctx)
-	}
-
-	return client, nil
 }
 
 func (h *HTTP) Connect() error {
@@ -153,8 +226,15 @@ func (h *HTTP) Connect() error {
 		return err
 	}
 
+	client, err = h.authConfig().NewClient(ctx, client)
+	if err != nil {
+		return err
+	}
+
 	h.client = client
 
+	confirmUpdateHealthy()
+
 	return nil
 }
 
@@ -180,23 +260,46 @@ func (h *HTTP) Write(metrics []telegraf.Metric) error {
 }
 
 func (h *HTTP) write(reqBody []byte) error {
-	var reqBodyBuffer io.Reader = bytes.NewBuffer(reqBody)
-
-	var err error
+	body := reqBody
 	if h.ContentEncoding == "gzip" {
-		rc, err := internal.CompressWithGzip(reqBodyBuffer)
+		rc, err := internal.CompressWithGzip(bytes.NewBuffer(reqBody))
+		if err != nil {
+			return err
+		}
+		compressed, err := ioutil.ReadAll(rc)
+		rc.Close()
 		if err != nil {
 			return err
 		}
-		defer rc.Close()
-		reqBodyBuffer = rc
+		body = compressed
 	}
 
-	req, err := http.NewRequest(h.Method, h.URL, reqBodyBuffer)
+	statusCode, bodyBytes, header, err := h.doWriteWithRetry(body)
 	if err != nil {
 		return err
 	}
 
+	// Side effects below must happen exactly once per successful write, so
+	// they live outside doWriteWithRetry's retry loop: a retried request
+	// only ever reaches here after the attempt that actually returned 2xx.
+	if statusCode == http.StatusOK {
+		return h.updateInputPluginConfig(bodyBytes, header.Get("Content-Type"))
+	} else if statusCode == http.StatusAccepted {
+		return h.updateTelegraf()
+	}
+
+	return nil
+}
+
+// buildWriteRequest constructs a fresh request for one write attempt. A new
+// *http.Request is needed per attempt because its body reader is consumed
+// by the previous attempt.
+func (h *HTTP) buildWriteRequest(body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(h.Method, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
 	if h.Username != "" || h.Password != "" {
 		req.SetBasicAuth(h.Username, h.Password)
 	}
@@ -213,42 +316,204 @@ func (h *HTTP) write(reqBody []byte) error {
 		req.Header.Set(k, v)
 	}
 
-	err = h.addConfigParams(req)
-	if err != nil {
-		return err
+	if err := h.addConfigParams(req); err != nil {
+		return nil, err
 	}
 
-	resp, err := h.client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	return req, nil
+}
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("when writing to [%s] received status code: %d", h.URL, resp.StatusCode)
-	}
-	if err != nil {
-		return fmt.Errorf("when writing to [%s] received error: %v", h.URL, err)
+// doWriteWithRetry sends the write request, retrying on the status codes in
+// retry_on_status with full-jitter exponential backoff (honoring
+// Retry-After) while a per-URL circuit breaker is closed. It returns the
+// status code, body and headers of whichever attempt finally succeeded or
+// exhausted max_retries.
+//
+// The breaker is only consulted once, before this call's own retry
+// sequence, and only recorded once, after that sequence is done: it exists
+// to stop a URL that is already down from paying for max_retries attempts
+// on every write, not to interrupt a single write's own retries, which
+// would make a transient blip worse than having no retries at all.
+func (h *HTTP) doWriteWithRetry(body []byte) (statusCode int, bodyBytes []byte, header http.Header, err error) {
+	policy := h.retryPolicy()
+	breaker := getCircuitBreaker(h.URL, policy.BreakerCooldown)
+
+	if !breaker.allow() {
+		return 0, nil, nil, fmt.Errorf("circuit breaker open for [%s]", h.URL)
 	}
 
-	if resp.StatusCode == http.StatusOK {
-		err = h.updateInputPluginConfig(bodyBytes)
+	var lastErr error
+	for attempt := 0; attempt <= policy.MaxRetries; attempt++ {
+		req, err := h.buildWriteRequest(body)
 		if err != nil {
-			return err
+			return 0, nil, nil, err
 		}
-	} else if resp.StatusCode == http.StatusAccepted {
-		err = h.updateTelegraf()
+
+		resp, err := h.client.Do(req)
 		if err != nil {
-			return err
+			lastErr = err
+			if attempt == policy.MaxRetries {
+				break
+			}
+			h.logger().Warn().Err(err).Int("attempt", attempt).Msg("write failed, retrying")
+			sleepBackoff(attempt, policy, 0)
+			continue
+		}
+
+		respBody, readErr := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			breaker.recordSuccess()
+			return resp.StatusCode, respBody, resp.Header, readErr
+		}
+
+		statusErr := fmt.Errorf("when writing to [%s] received status code: %d", h.URL, resp.StatusCode)
+		if !shouldRetryStatus(resp.StatusCode, policy.RetryOnStatus) || attempt == policy.MaxRetries {
+			breaker.recordFailure()
+			return resp.StatusCode, respBody, resp.Header, statusErr
 		}
+
+		lastErr = statusErr
+		h.logger().Warn().Int("status", resp.StatusCode).Int("attempt", attempt).Msg("write failed, retrying")
+		sleepBackoff(attempt, policy, retryAfterDuration(resp.Header))
 	}
 
-	return nil
+	breaker.recordFailure()
+	return 0, nil, nil, lastErr
+}
+
+// retryPolicy is the resolved, defaulted form of the write-retry TOML
+// options.
+type retryPolicy struct {
+	MaxRetries      int
+	InitialBackoff  time.Duration
+	MaxBackoff      time.Duration
+	RetryOnStatus   []int
+	BreakerCooldown time.Duration
+}
+
+func (h *HTTP) retryPolicy() retryPolicy {
+	p := retryPolicy{
+		MaxRetries:      defaultMaxRetries,
+		InitialBackoff:  defaultInitialBackoff,
+		MaxBackoff:      defaultMaxBackoff,
+		RetryOnStatus:   defaultRetryOnStatus,
+		BreakerCooldown: defaultBreakerCooldown,
+	}
+
+	if h.MaxRetries > 0 {
+		p.MaxRetries = h.MaxRetries
+	}
+	if h.InitialBackoff.Duration > 0 {
+		p.InitialBackoff = h.InitialBackoff.Duration
+	}
+	if h.MaxBackoff.Duration > 0 {
+		p.MaxBackoff = h.MaxBackoff.Duration
+	}
+	if len(h.RetryOnStatus) > 0 {
+		p.RetryOnStatus = h.RetryOnStatus
+	}
+	if h.BreakerCooldown.Duration > 0 {
+		p.BreakerCooldown = h.BreakerCooldown.Duration
+	}
+
+	return p
+}
+
+func shouldRetryStatus(status int, retryOnStatus []int) bool {
+	for _, s := range retryOnStatus {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// retryAfterDuration parses a Retry-After header expressed in seconds. A
+// missing or unparsable header falls back to the backoff schedule instead.
+func retryAfterDuration(header http.Header) time.Duration {
+	v := header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// sleepBackoff waits with full-jitter exponential backoff before the next
+// retry attempt, honoring a server-requested minimum (e.g. Retry-After) when
+// it is the longer of the two.
+func sleepBackoff(attempt int, policy retryPolicy, minDelay time.Duration) {
+	backoff := policy.InitialBackoff << uint(attempt)
+	if backoff <= 0 || backoff > policy.MaxBackoff {
+		backoff = policy.MaxBackoff
+	}
+
+	delay := time.Duration(rand.Int63n(int64(backoff) + 1))
+	if minDelay > delay {
+		delay = minDelay
+	}
+
+	time.Sleep(delay)
+}
+
+// circuitBreaker trips open after a write failure and refuses further
+// writes to the same URL until breakerCooldown has passed, at which point a
+// single half-open probe is allowed through.
+type circuitBreaker struct {
+	cooldown time.Duration
+
+	mu    sync.Mutex
+	open  bool
+	since time.Time
+}
+
+var circuitBreakers sync.Map // map[string]*circuitBreaker
+
+func getCircuitBreaker(url string, cooldown time.Duration) *circuitBreaker {
+	v, _ := circuitBreakers.LoadOrStore(url, &circuitBreaker{cooldown: cooldown})
+	b := v.(*circuitBreaker)
+	b.mu.Lock()
+	b.cooldown = cooldown
+	b.mu.Unlock()
+	return b
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return true
+	}
+	if time.Since(b.since) < b.cooldown {
+		return false
+	}
+	// Restart the cooldown so only this probe gets through until its result
+	// is recorded.
+	b.since = time.Now()
+	return true
+}
+
+func (b *circuitBreaker) recordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.open = false
+}
+
+func (b *circuitBreaker) recordFailure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.open = true
+	b.since = time.Now()
 }
 
 func (h *HTTP) addConfigParams(req *http.Request) error {
-	log.Printf("D! Bridge address : %s", h.URL)
+	h.logger().Debug().Msg("bridge address")
 	q := req.URL.Query()
 
 	isTinyCore := isTinyCore(h.ConfigFilePath)
@@ -265,414 +530,459 @@ func (h *HTTP) addConfigParams(req *http.Request) error {
 	q.Add("configErrorCode", strconv.Itoa(configErrorCode))
 	q.Add("isWindows", strconv.FormatBool(runtime.GOOS == "windows"))
 	q.Add("source", h.SourceAddress)
+	q.Add("plugins", strings.Join(supportedInputPlugins(), ","))
 	req.URL.RawQuery = q.Encode()
 	return nil
 }
 
-func (h *HTTP) updateInputPluginConfig(bodyBytes []byte) error {
+// updateInputPluginConfig applies a server-delivered input plugin config to
+// telegraf.conf. The body is either raw TOML (today's default) or, when
+// contentType is application/json, a manifest of per-plugin JSON descriptors
+// that is first translated into TOML via tomlfragment.
+func (h *HTTP) updateInputPluginConfig(bodyBytes []byte, contentType string) error {
 	inputPluginConfig := string(bodyBytes)
-	log.Printf("I! New input plugin config received : >>%s<<", inputPluginConfig)
+
+	if strings.HasPrefix(contentType, "application/json") {
+		var descriptors []tomlfragment.Descriptor
+		if err := json.Unmarshal(bodyBytes, &descriptors); err != nil {
+			return fmt.Errorf("parsing config manifest: %w", err)
+		}
+
+		fragment, err := tomlfragment.MarshalAll(descriptors, runtime.GOOS)
+		if err != nil {
+			return err
+		}
+		inputPluginConfig = fragment
+	}
+
+	h.logger().Debug().Str("event", "config_received").Msg("new input plugin config received")
 	if len(strings.TrimSpace(inputPluginConfig)) == 0 {
 		return nil
 	}
-	err := updateInputPluginConfig(inputPluginConfig, h.ConfigFilePath)
+
+	err := configpatch.New(h.ConfigFilePath).Apply(inputPluginConfig)
 	if err != nil {
-		return err
+		var verr *configpatch.ValidationError
+		if !errors.As(err, &verr) {
+			return err
+		}
+
+		configErrorCode = 1
+		h.logger().Warn().Str("event", "config_rejected").Err(err).Msg("received configuration is invalid and was ignored")
+		return nil
 	}
-	return nil
+
+	return reloadConfig()
 }
 
-func (h *HTTP) updateTelegraf() error {
-	req, err := http.NewRequest(http.MethodGet, h.URL+"Update", nil)
-	if err != nil {
-		return err
+// supportedInputPlugins lists the input plugins compiled into this binary,
+// so the bridge knows which server-delivered plugin tables can actually be
+// applied.
+func supportedInputPlugins() []string {
+	names := make([]string, 0, len(inputs.Inputs))
+	for name := range inputs.Inputs {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
+}
 
-	revision, err := getRevision(h.ConfigFilePath)
+// updateManifest is the signed document a bridge serves at URL+"Update/manifest"
+// describing the binary that URL+"Update" will return. Sig is the base64
+// standard encoding of an Ed25519 signature over "version:sha256:size".
+type updateManifest struct {
+	Version string `json:"version"`
+	SHA256  string `json:"sha256"`
+	Size    int64  `json:"size"`
+	Sig     string `json:"sig"`
+}
+
+func (m updateManifest) signedMessage() []byte {
+	return []byte(fmt.Sprintf("%s:%s:%d", m.Version, m.SHA256, m.Size))
+}
+
+// verify checks m.Sig against every pinned public key in keys, succeeding if
+// any one of them validates. This is what makes update_public_keys an
+// additive key-rotation mechanism rather than a single point of failure.
+func (m updateManifest) verify(keys []ed25519.PublicKey) error {
+	if len(keys) == 0 {
+		return errors.New("no update_public_key configured, refusing to trust update manifest")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(m.Sig)
 	if err != nil {
-		return err
+		return fmt.Errorf("decoding manifest signature: %w", err)
 	}
 
-	log.Printf("I! Checking for updates... Current revision is {%s}", revision)
+	msg := m.signedMessage()
+	for _, key := range keys {
+		if ed25519.Verify(key, msg, sig) {
+			return nil
+		}
+	}
 
-	q := req.URL.Query()
-	q.Add("isWindows", strconv.FormatBool(runtime.GOOS == "windows"))
-	q.Add("source", h.SourceAddress)
-	q.Add("revision", revision)
-	req.URL.RawQuery = q.Encode()
+	return errors.New("update manifest signature does not match any pinned update_public_key")
+}
 
+// fetchUpdateManifest retrieves and signature-checks the manifest that must
+// precede every binary download.
+func (h *HTTP) fetchUpdateManifest() (*updateManifest, error) {
+	req, err := http.NewRequest(http.MethodGet, h.URL+"Update/manifest", nil)
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Set("User-Agent", "Telegraf/"+internal.Version())
-	req.Header.Set("Content-Type", defaultContentType)
 
 	resp, err := h.client.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil
+		return nil, fmt.Errorf("fetching update manifest: status code %d", resp.StatusCode)
+	}
+
+	var manifest updateManifest
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("decoding update manifest: %w", err)
+	}
+
+	keys, err := h.updatePublicKeys()
+	if err != nil {
+		return nil, err
+	}
+	if err := manifest.verify(keys); err != nil {
+		return nil, err
+	}
+
+	return &manifest, nil
+}
+
+// updatePublicKeys decodes UpdatePublicKey and the UpdatePublicKeys rotation
+// set into verification keys. Keys are hex-encoded Ed25519 public keys.
+func (h *HTTP) updatePublicKeys() ([]ed25519.PublicKey, error) {
+	raw := h.UpdatePublicKeys
+	if h.UpdatePublicKey != "" {
+		raw = append([]string{h.UpdatePublicKey}, raw...)
+	}
+
+	keys := make([]ed25519.PublicKey, 0, len(raw))
+	for _, k := range raw {
+		decoded, err := hex.DecodeString(k)
+		if err != nil {
+			return nil, fmt.Errorf("decoding update_public_key: %w", err)
+		}
+		if len(decoded) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("update_public_key must be %d bytes, got %d", ed25519.PublicKeySize, len(decoded))
+		}
+		keys = append(keys, ed25519.PublicKey(decoded))
 	}
 
-	binaryPath := "/tmp/telegraf"
+	return keys, nil
+}
 
+// updateBinaryPath returns where the downloaded update binary is staged.
+// It deliberately lives next to the binary it will replace (rather than in
+// /tmp) so the final rename is same-filesystem and can't fail with
+// cross-device link errors.
+func (h *HTTP) updateBinaryPath() string {
 	if runtime.GOOS == "windows" {
-		binaryPath = h.ConfigFilePath + string(os.PathSeparator) + "telegraf.exe.new"
+		return h.ConfigFilePath + string(os.PathSeparator) + "telegraf.exe.new"
+	}
+
+	dir := h.ConfigFilePath
+	if exe, err := osext.Executable(); err == nil {
+		dir = filepath.Dir(exe)
+	}
+	return filepath.Join(dir, "telegraf.new")
+}
+
+// downloadUpdateBinary fetches the binary at h.URL+"Update", resuming a
+// previous attempt's ".part" file with a Range request when possible, and
+// verifies the complete download against manifest.SHA256 before renaming
+// it into place. noUpdate is true when the bridge reports no update is
+// available, distinct from a download or verification failure.
+func (h *HTTP) downloadUpdateBinary(manifest *updateManifest, revision string) (path string, noUpdate bool, err error) {
+	binaryPath := h.updateBinaryPath()
+	partPath := binaryPath + ".part"
+
+	var existingSize int64
+	if fi, statErr := os.Stat(partPath); statErr == nil {
+		existingSize = fi.Size()
 	}
 
-	out, err := os.Create(binaryPath)
+	req, err := http.NewRequest(http.MethodGet, h.URL+"Update", nil)
 	if err != nil {
-		return err
+		return "", false, err
 	}
 
-	defer out.Close()
+	q := req.URL.Query()
+	q.Add("isWindows", strconv.FormatBool(runtime.GOOS == "windows"))
+	q.Add("source", h.SourceAddress)
+	q.Add("revision", revision)
+	q.Add("version", manifest.Version)
+	req.URL.RawQuery = q.Encode()
 
-	_, err = io.Copy(out, resp.Body)
+	req.Header.Set("User-Agent", "Telegraf/"+internal.Version())
+	req.Header.Set("Content-Type", defaultContentType)
+	if existingSize > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", existingSize))
+	}
 
-	log.Printf("I! Update downloded successfully")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
 
-	if runtime.GOOS == "windows" {
-		md5, err := getFileMd5(binaryPath)
-		if err != nil {
-			return err
-		}
-		log.Printf("I! New revision {%}", md5)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return "", true, nil
+	}
 
-		d1 := []byte(md5)
-		err = ioutil.WriteFile(h.ConfigFilePath+string(os.PathSeparator)+"telegraf-revision.new", d1, 0755)
+	hasher := sha256.New()
+	resuming := existingSize > 0 && resp.StatusCode == http.StatusPartialContent && resp.Header.Get("Content-Range") != ""
+
+	var out *os.File
+	if resuming {
+		existing, openErr := os.Open(partPath)
+		if openErr != nil {
+			return "", false, openErr
+		}
+		_, err = io.Copy(hasher, existing)
+		existing.Close()
 		if err != nil {
-			return err
+			return "", false, err
 		}
-		log.Printf("I! Revision file written successfully")
 
-		err = os.Chdir(h.ConfigFilePath)
+		out, err = os.OpenFile(partPath, os.O_APPEND|os.O_WRONLY, 0644)
 		if err != nil {
-			return err
+			return "", false, err
 		}
-
-		cmd := exec.Command("cmd.exe", "/C", "update.bat")
-		output, err := cmd.CombinedOutput()
+	} else {
+		// Either a fresh download, or the server ignored our Range request
+		// (no Accept-Ranges support) -- start over from scratch. The file is
+		// created executable since it is renamed over the running binary.
+		out, err = os.OpenFile(partPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
 		if err != nil {
-			log.Printf("I! Error running command %s", err)
+			return "", false, err
 		}
+	}
 
-		log.Printf("I! Afer requesting restart %s", string(output))
-	} else {
-		log.Printf("I! Restarting service to apply the update ...")
-		os.Exit(1)
+	_, err = io.Copy(out, io.TeeReader(resp.Body, hasher))
+	if err != nil {
+		out.Close()
+		return "", false, err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return "", false, err
+	}
+	if err := out.Close(); err != nil {
+		return "", false, err
 	}
 
-	return err
-}
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	if sum != manifest.SHA256 {
+		os.Remove(partPath)
+		return "", false, fmt.Errorf("update checksum mismatch: expected %s, got %s", manifest.SHA256, sum)
+	}
 
-func init() {
-	outputs.Add("http", func() telegraf.Output {
-		return &HTTP{
-			Method: defaultMethod,
-			URL:    defaultURL,
-		}
-	})
-}
+	if err := os.Rename(partPath, binaryPath); err != nil {
+		return "", false, err
+	}
 
-func updateInputPluginConfig(inputPluginConfig string, configFilePath string) error {
-	const InputPluginStart = "#                            INPUT PLUGINS                                    #"
-	const PluginEnd = "###############################################################################"
+	return binaryPath, false, nil
+}
 
-	err := os.Chdir(configFilePath)
+func (h *HTTP) updateTelegraf() error {
+	revision, err := getRevision(h.ConfigFilePath)
 	if err != nil {
 		return err
 	}
 
-	// create a new temp config file
-	fout, err := os.Create("telegraf.conf.new")
+	h.logger().Info().Str("event", "update_started").Msg("checking for updates")
+
+	manifest, err := h.fetchUpdateManifest()
 	if err != nil {
+		h.logger().Warn().Str("event", "update_rejected").Err(err).Msg("rejecting update, manifest invalid")
 		return err
 	}
 
-	// read the current config file
-	fin, err := os.OpenFile("telegraf.conf", os.O_RDONLY, os.ModePerm)
+	binaryPath, noUpdate, err := h.downloadUpdateBinary(manifest, revision)
 	if err != nil {
+		h.logger().Warn().Str("event", "update_rejected").Err(err).Msg("update download failed verification")
 		return err
 	}
+	if noUpdate {
+		return nil
+	}
 
-	rd := bufio.NewReader(fin)
-
-	// read the file and write to the ouptput file until the start of Input Plugin section
-	copyLineToOutput := true
-	lineNumber := 1
-	inputPluginLinesStart := 0
+	h.logger().Info().Str("event", "update_downloaded").Str("sha256", manifest.SHA256).Str("path", binaryPath).Msg("update downloaded successfully")
 
-	for {
-		line, err := rd.ReadString('\n')
+	if runtime.GOOS == "windows" {
+		manifestPath := h.ConfigFilePath + string(os.PathSeparator) + "telegraf.exe.manifest.json"
+		manifestBytes, err := json.Marshal(manifest)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
 			return err
 		}
-
-		// calculate the start line number of input plugin config section
-		if strings.Contains(line, InputPluginStart) && inputPluginLinesStart == 0 {
-			inputPluginLinesStart = lineNumber + 4
+		if err := ioutil.WriteFile(manifestPath, manifestBytes, 0644); err != nil {
+			return err
 		}
 
-		// insert timestamp (This use two lines)
-		if lineNumber == inputPluginLinesStart-2 {
-			_, err2 := fmt.Fprint(fout, fmt.Sprintf("# Config last updated on: %s                           #\n", time.Now().Format(time.RFC3339)))
-			if err2 != nil {
-				return err
-			}
+		d1 := []byte(manifest.SHA256)
+		err = ioutil.WriteFile(h.ConfigFilePath+string(os.PathSeparator)+"telegraf-revision.new", d1, 0755)
+		if err != nil {
+			return err
 		}
+		h.logger().Info().Msg("revision file written successfully")
 
-		// do not output plugin config section and revsion/timestamp line (2 lines with the newline) to output file
-		if lineNumber == inputPluginLinesStart-2 {
-			copyLineToOutput = false
-
-			_, err := fmt.Fprintln(fout)
-			if err != nil {
-				return err
-			}
-
-			_, err = fmt.Fprint(fout, inputPluginConfig)
-			if err != nil {
-				return err
-			}
-
-			_, err = fmt.Fprintln(fout)
-			if err != nil {
-				return err
-			}
+		err = os.Chdir(h.ConfigFilePath)
+		if err != nil {
+			return err
 		}
 
-		// start copying content to output file when input plugin config section end
-		if strings.Contains(line, PluginEnd) && lineNumber > inputPluginLinesStart {
-			copyLineToOutput = true
+		// update.bat is expected to re-verify telegraf.exe.manifest.json
+		// against telegraf.exe.new, keep the replaced binary as
+		// telegraf.exe.prev for one cycle, and roll back to it if the new
+		// binary fails to start.
+		cmd := exec.Command("cmd.exe", "/C", "update.bat")
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			h.logger().Warn().Err(err).Msg("error running update command")
 		}
 
-		// write all lines from original config file to new config files excluding input plugin config section
-		if copyLineToOutput == true {
-			_, err := fmt.Fprint(fout, line)
-			if err != nil {
-				return err
-			}
+		h.logger().Info().Str("output", string(output)).Msg("requested restart")
+	} else {
+		current, err := osext.Executable()
+		if err != nil {
+			return err
 		}
 
-		lineNumber++
-	}
-
-	err = fout.Close()
-	if err != nil {
-		return err
-	}
+		if err := backupCurrentBinary(current); err != nil {
+			h.logger().Warn().Err(err).Msg("could not keep a rollback copy of the current binary")
+		}
 
-	err = fin.Close()
-	if err != nil {
-		return err
-	}
+		if err := os.Rename(binaryPath, current); err != nil {
+			return fmt.Errorf("installing downloaded update: %w", err)
+		}
 
-	errorCode, err := testConfig(inputPluginConfig)
-	if err != nil {
-		log.Printf("W! Received configuration is invalid and was ignored [Error Code : %d]. {%s}", errorCode, err)
-		configErrorCode = errorCode;
-		err = os.Remove("telegraf.conf.new")
-		if err != nil {
-			return err
+		if err := ioutil.WriteFile(bootMarkerPath(current), nil, 0644); err != nil {
+			h.logger().Warn().Err(err).Msg("could not record pending-update marker, rollback on boot failure is disabled for this cycle")
 		}
-		return nil
-	}
 
-	// We are here only if received config is valid
-	err = os.Remove("telegraf.conf")
-	if err != nil {
-		return err
+		h.logger().Info().Msg("restarting service to apply the update")
+		os.Exit(1)
 	}
 
-	// rename new config file
-	err = os.Rename("telegraf.conf.new", "telegraf.conf")
+	return nil
+}
+
+// backupCurrentBinary copies the running binary at current to current+".prev"
+// so rollbackPendingUpdate can restore and re-exec it if the updated binary
+// fails its first start.
+func backupCurrentBinary(current string) error {
+	in, err := os.Open(current)
 	if err != nil {
 		return err
 	}
+	defer in.Close()
 
-	// restart Telegraf to load new input plugin configs
-	err = reloadConfig()
+	out, err := os.OpenFile(current+".prev", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
 	if err != nil {
 		return err
 	}
+	defer out.Close()
 
-	return nil
+	_, err = io.Copy(out, in)
+	return err
 }
 
-func testConfig(inputPluginConfig string) (int, error) {
-	log.Printf("I! Testing received configuration ...")
-
-	var err error
-	errorCode := 0
-
-	defer func() {
-		if r := recover(); err != nil {
-			errorCode = 1
-			switch x := r.(type) {
-			case string:
-				err = errors.New(x)
-			case error:
-				err = x
-			default:
-				err = errors.New("Unknown error.")
-			}
-		}
-	}()
+// bootMarkerPath and bootAttemptsPath name the two files updateTelegraf and
+// rollbackPendingUpdate use to track whether the binary currently at exe was
+// installed by an update that hasn't yet proven itself by reaching a
+// successful Connect().
+func bootMarkerPath(exe string) string {
+	return exe + ".update-pending"
+}
 
-	testContext, _ := context.WithCancel(context.Background())
-	c := config.NewConfig()
+func bootAttemptsPath(exe string) string {
+	return exe + ".update-boot-attempted"
+}
 
-	err = c.LoadConfig("telegraf.conf.new")
+// rollbackPendingUpdate runs once at process start, before any plugin is
+// configured. updateTelegraf leaves a marker next to the binary it installs;
+// if that marker is still present on a *second* boot of this binary (i.e.
+// the previous boot never reached confirmUpdateHealthy), the new binary is
+// considered unable to start and the ".prev" copy backupCurrentBinary kept
+// is restored and re-exec'd, giving the update exactly one boot cycle to
+// prove itself before it's rolled back.
+func rollbackPendingUpdate() {
+	exe, err := osext.Executable()
 	if err != nil {
-		return 2, err
+		return
 	}
 
-	ag, err := agent.NewAgent(c)
-	if err != nil {
-		return 3, err
+	marker := bootMarkerPath(exe)
+	if _, err := os.Stat(marker); err != nil {
+		return
 	}
-	agent.NErrors.Set(0)
 
-	err = ag.Test(testContext, 0)
-	if err != nil {
-		agent.NErrors.Set(0)
-		return 4, err
+	attempts := bootAttemptsPath(exe)
+	if _, err := os.Stat(attempts); err != nil {
+		_ = ioutil.WriteFile(attempts, nil, 0644)
+		return
 	}
 
-	if strings.Contains(inputPluginConfig, "[[inputs.win_perf_counters]]") {
-		return testWinPrefConfig(inputPluginConfig)
+	Logger.Warn().Str("event", "revision_rollback").Str("path", exe).
+		Msg("new binary failed to reach a healthy start on its first boot, rolling back to the previous binary")
+
+	if err := os.Rename(exe+".prev", exe); err != nil {
+		Logger.Error().Err(err).Msg("rollback failed: could not restore previous binary")
+		return
 	}
+	os.Remove(marker)
+	os.Remove(attempts)
 
-	return errorCode, nil
+	if err := syscall.Exec(exe, os.Args, os.Environ()); err != nil {
+		Logger.Error().Err(err).Msg("rollback failed: could not re-exec previous binary")
+	}
 }
 
-func testWinPrefConfig(inputPluginConfig string) (int, error) {
-	var err error
-	errorCode := 0
-
-	winPrefHeader := ""
-	winPerfObjects := make([]string, 0)
-	agentConfig := ""
-
-	lines := strings.Split(inputPluginConfig,"\n")
-
-	readingWinPrefHeader := false
-	readingPrefObject := false
-	readingAgentConfig := false
-
-
-	var pluginBuffer bytes.Buffer
-
-	for _, line := range lines {
-		if strings.Contains(line, "[[inputs.win_perf_counters]]") {
-			readingWinPrefHeader = true
-		}
-
-		if readingWinPrefHeader && strings.Contains(line, "[[inputs.win_perf_counters.object]]") {
-			readingWinPrefHeader = false
-			winPrefHeader = pluginBuffer.String()
-			pluginBuffer.Reset()
-			readingPrefObject = true
-			pluginBuffer.WriteString(line)
-			pluginBuffer.WriteString("\n")
-			continue
-		}
-
-		if readingPrefObject && strings.Contains(line, "[[inputs.win_perf_counters.object]]") {
-			winPerfObjects = append(winPerfObjects, pluginBuffer.String())
-			pluginBuffer.Reset()
-			pluginBuffer.WriteString(line)
-			pluginBuffer.WriteString("\n")
-			continue
-		}
-
-		if readingPrefObject && strings.Contains(line, "[[inputs.") && !strings.Contains(line, "[[inputs.win_perf_counters.object]]") {
-			winPerfObjects = append(winPerfObjects, pluginBuffer.String())
-			pluginBuffer.Reset()
-			pluginBuffer.WriteString(line)
-			pluginBuffer.WriteString("\n")
-			continue
-		}
-
-		if strings.Contains(line, "[[inputs.config]]") {
-			readingAgentConfig = true
-		}
-
-		if readingWinPrefHeader || readingPrefObject || readingAgentConfig {
-			pluginBuffer.WriteString(line)
-			pluginBuffer.WriteString("\n")
-		}
+// confirmUpdateHealthy clears the pending-update marker once this instance
+// has connected successfully, so rollbackPendingUpdate knows the binary
+// installed by the last updateTelegraf is good and stops tracking it.
+func confirmUpdateHealthy() {
+	exe, err := osext.Executable()
+	if err != nil {
+		return
 	}
 
-	agentConfig = pluginBuffer.String()
-
-	for id, winPerfObject := range winPerfObjects {
-
-		tempConfigFileName := "telegraf.conf.win_pref_test_" + strconv.Itoa(id)
-		// create a new temp config file
-		fout, err := os.Create(tempConfigFileName)
-		if err != nil {
-			return 1, err
-		}
-
-		defer func() {
-			e := os.Remove(tempConfigFileName)
-			if e != nil {
-				errorCode = 1
-				err = e
-			}
-		}()
-
-		_, err = fmt.Fprint(fout, winPrefHeader)
-		if err != nil {
-			return 1, err
-		}
-
-		_, err = fmt.Fprint(fout, winPerfObject)
-		if err != nil {
-			return 1, err
-		}
-
-		_, err = fmt.Fprint(fout, agentConfig)
-		if err != nil {
-			return 1, err
-		}
-
-		err = fout.Close()
-		if err != nil {
-			return 1, err
-		}
+	marker := bootMarkerPath(exe)
+	if _, err := os.Stat(marker); err != nil {
+		return
+	}
 
-		testContext, _ := context.WithCancel(context.Background())
-		c := config.NewConfig()
+	os.Remove(marker)
+	os.Remove(bootAttemptsPath(exe))
+	os.Remove(exe + ".prev")
 
-		err = c.LoadConfig(tempConfigFileName)
-		if err != nil {
-			return 2, err
-		}
+	Logger.Info().Str("event", "update_confirmed").Str("path", exe).Msg("update reached a healthy start, rollback copy discarded")
+}
 
-		ag, err := agent.NewAgent(c)
-		if err != nil {
-			return 3, err
-		}
-		agent.NErrors.Set(0)
+func init() {
+	rollbackPendingUpdate()
 
-		err = ag.Test(testContext, 0)
-		if err != nil {
-			agent.NErrors.Set(0)
-			return 4, err
+	outputs.Add("http", func() telegraf.Output {
+		return &HTTP{
+			Method: defaultMethod,
+			URL:    defaultURL,
 		}
-	}
-
-	return errorCode, err
+	})
 }
 
 func reloadConfig() error {
-	log.Println("I! Loading new configuration ...")
+	Logger.Info().Msg("loading new configuration")
 
 	if runtime.GOOS == "windows" {
 		cmd := exec.Command("telegraf.exe", "--service", "restart")
@@ -712,33 +1022,11 @@ func getRevision(path string) (string, error) {
 		return "", err
 	}
 
-	log.Printf("I! Current revision is {%s}", revision)
+	Logger.Info().Str("revision", revision).Msg("current revision")
 
 	return revision, nil
 }
 
-func getFileMd5(path string) (string, error) {
-	var fileMd5 string
-
-	file, err := os.Open(path)
-	if err != nil {
-		return fileMd5, err
-	}
-
-	defer file.Close()
-
-	hash := md5.New()
-
-	if _, err := io.Copy(hash, file); err != nil {
-		return fileMd5, err
-	}
-
-	hashInBytes := hash.Sum(nil)[:16]
-	fileMd5 = hex.EncodeToString(hashInBytes)
-
-	return fileMd5, nil
-}
-
 
 func isTinyCore(path string) bool {
 	if _, err := os.Stat(path+string(os.PathSeparator)+"os-tinycore"); err != nil {
@@ -0,0 +1,186 @@
+// Package tomlfragment turns the JSON plugin descriptors served by a
+// manifest-aware bridge into TOML input plugin fragments that can be fed
+// into configpatch.
+package tomlfragment
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// Descriptor is one entry of a JSON config manifest, analogous to the
+// plugin catalog entries served by the InfluxDB telegraf-config API.
+type Descriptor struct {
+	Name    string                 `json:"name"`
+	OS      string                 `json:"os"`
+	Enabled bool                   `json:"enabled"`
+	Config  map[string]interface{} `json:"config"`
+}
+
+// Marshal renders a single Descriptor as an `[[inputs.<name>]]` TOML table.
+// Disabled descriptors render as an empty string so callers can filter them
+// out without special-casing the concatenation step.
+func Marshal(d Descriptor) (string, error) {
+	if !d.Enabled {
+		return "", nil
+	}
+
+	var buf bytes.Buffer
+	if err := marshalTable(&buf, fmt.Sprintf("inputs.%s", d.Name), d.Config); err != nil {
+		return "", fmt.Errorf("tomlfragment: %s: %w", d.Name, err)
+	}
+
+	return buf.String(), nil
+}
+
+// MarshalAll renders every enabled, OS-matching descriptor and concatenates
+// the result into a single TOML fragment suitable for configpatch.Apply.
+func MarshalAll(descriptors []Descriptor, goos string) (string, error) {
+	var buf bytes.Buffer
+	for _, d := range descriptors {
+		if d.OS != "" && d.OS != goos {
+			continue
+		}
+		fragment, err := Marshal(d)
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString(fragment)
+	}
+
+	return buf.String(), nil
+}
+
+// marshalTable renders table as a `[[prefix]]` array-of-tables header
+// followed by its body. Every top-level inputs.<name> table is written this
+// way, since telegraf allows more than one instance of a plugin.
+func marshalTable(buf *bytes.Buffer, prefix string, table map[string]interface{}) error {
+	fmt.Fprintf(buf, "[[%s]]\n", prefix)
+	return marshalTableBody(buf, prefix, table)
+}
+
+// marshalSingleTable renders table as a `[prefix]` single-table header
+// followed by its body. A nested map[string]interface{} value (e.g. a
+// plugin's `tags` sub-table) is a single TOML table, not an array of
+// tables: pelletier/go-toml parses `[[prefix]]` back as []*toml.Tree, the
+// wrong Go type for a map field.
+func marshalSingleTable(buf *bytes.Buffer, prefix string, table map[string]interface{}) error {
+	fmt.Fprintf(buf, "[%s]\n", prefix)
+	return marshalTableBody(buf, prefix, table)
+}
+
+// marshalTableBody writes table's scalar keys, then recurses into nested
+// tables and arrays of tables (the shape plugins like win_perf_counters need
+// for their `[[inputs.win_perf_counters.object]]` entries). Keys are
+// visited in sorted order so the same Config map always produces
+// byte-identical output, since Go map iteration order is otherwise random.
+func marshalTableBody(buf *bytes.Buffer, prefix string, table map[string]interface{}) error {
+	keys := sortedKeys(table)
+
+	var nestedKeys []string
+	for _, key := range keys {
+		value := table[key]
+		if isNested(value) {
+			nestedKeys = append(nestedKeys, key)
+			continue
+		}
+
+		line, err := marshalScalar(key, value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		buf.WriteString(line)
+	}
+
+	for _, key := range nestedKeys {
+		if err := marshalNested(buf, prefix+"."+key, table[key]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// marshalNested renders a sub-table (map[string]interface{}, a single
+// `[prefix]` table) or array of sub-tables ([]interface{} of
+// map[string]interface{}, one `[[prefix]]` table per element) under prefix.
+func marshalNested(buf *bytes.Buffer, prefix string, value interface{}) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return marshalSingleTable(buf, prefix, v)
+	case []interface{}:
+		for _, item := range v {
+			sub, ok := item.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s: array of tables must contain only objects, got %T", prefix, item)
+			}
+			if err := marshalTable(buf, prefix, sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("%s: unsupported nested value type %T", prefix, value)
+	}
+}
+
+// isNested reports whether value should be rendered as a nested table or
+// array of tables, as opposed to a scalar value like `tags = ["a", "b"]`.
+func isNested(value interface{}) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return true
+	case []interface{}:
+		if len(v) == 0 {
+			return false
+		}
+		_, ok := v[0].(map[string]interface{})
+		return ok
+	default:
+		return false
+	}
+}
+
+func marshalScalar(key string, v interface{}) (string, error) {
+	switch val := v.(type) {
+	case string:
+		return fmt.Sprintf("  %s = %q\n", key, val), nil
+	case bool:
+		return fmt.Sprintf("  %s = %t\n", key, val), nil
+	case float64:
+		return fmt.Sprintf("  %s = %v\n", key, val), nil
+	case []interface{}:
+		items := make([]string, 0, len(val))
+		for _, item := range val {
+			s, ok := item.(string)
+			if !ok {
+				return "", fmt.Errorf("unsupported array element type %T", item)
+			}
+			items = append(items, fmt.Sprintf("%q", s))
+		}
+		return fmt.Sprintf("  %s = [%s]\n", key, joinComma(items)), nil
+	default:
+		return "", fmt.Errorf("unsupported value type %T", v)
+	}
+}
+
+func sortedKeys(table map[string]interface{}) []string {
+	keys := make([]string, 0, len(table))
+	for k := range table {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func joinComma(items []string) string {
+	var buf bytes.Buffer
+	for i, item := range items {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(item)
+	}
+	return buf.String()
+}
@@ -0,0 +1,120 @@
+package tomlfragment
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshalScalarFieldsAreDeterministic(t *testing.T) {
+	d := Descriptor{
+		Name:    "cpu",
+		Enabled: true,
+		Config: map[string]interface{}{
+			"percpu":     true,
+			"totalcpu":   false,
+			"fieldpass":  []interface{}{"usage_idle", "usage_system"},
+			"name_alias": "cpu0",
+		},
+	}
+
+	want := "[[inputs.cpu]]\n" +
+		"  fieldpass = [\"usage_idle\", \"usage_system\"]\n" +
+		"  name_alias = \"cpu0\"\n" +
+		"  percpu = true\n" +
+		"  totalcpu = false\n"
+
+	for i := 0; i < 10; i++ {
+		got, err := Marshal(d)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+}
+
+func TestMarshalDisabledDescriptorIsEmpty(t *testing.T) {
+	got, err := Marshal(Descriptor{Name: "cpu", Enabled: false, Config: map[string]interface{}{"percpu": true}})
+	require.NoError(t, err)
+	require.Empty(t, got)
+}
+
+func TestMarshalNestedTableAndArrayOfTables(t *testing.T) {
+	d := Descriptor{
+		Name:    "win_perf_counters",
+		Enabled: true,
+		Config: map[string]interface{}{
+			"use_wildcards_expansion": true,
+			"object": []interface{}{
+				map[string]interface{}{
+					"object_name": "Processor",
+					"instances":   []interface{}{"*"},
+					"counters":    []interface{}{"% Processor Time"},
+				},
+				map[string]interface{}{
+					"object_name": "Memory",
+					"counters":    []interface{}{"Available Bytes"},
+				},
+			},
+			"tags": map[string]interface{}{
+				"role": "web",
+			},
+		},
+	}
+
+	want := "[[inputs.win_perf_counters]]\n" +
+		"  use_wildcards_expansion = true\n" +
+		"[[inputs.win_perf_counters.object]]\n" +
+		"  counters = [\"% Processor Time\"]\n" +
+		"  instances = [\"*\"]\n" +
+		"  object_name = \"Processor\"\n" +
+		"[[inputs.win_perf_counters.object]]\n" +
+		"  counters = [\"Available Bytes\"]\n" +
+		"  object_name = \"Memory\"\n" +
+		"[inputs.win_perf_counters.tags]\n" +
+		"  role = \"web\"\n"
+
+	got, err := Marshal(d)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+}
+
+func TestMarshalNestedMapUsesSingleBracketTable(t *testing.T) {
+	d := Descriptor{
+		Name:    "cpu",
+		Enabled: true,
+		Config: map[string]interface{}{
+			"tags": map[string]interface{}{"role": "web"},
+		},
+	}
+
+	got, err := Marshal(d)
+	require.NoError(t, err)
+	require.Contains(t, got, "[inputs.cpu.tags]\n")
+	require.NotContains(t, got, "[[inputs.cpu.tags]]")
+}
+
+func TestMarshalAllFiltersByOS(t *testing.T) {
+	descriptors := []Descriptor{
+		{Name: "win_perf_counters", OS: "windows", Enabled: true, Config: map[string]interface{}{}},
+		{Name: "cpu", OS: "", Enabled: true, Config: map[string]interface{}{}},
+	}
+
+	got, err := MarshalAll(descriptors, "linux")
+	require.NoError(t, err)
+	require.Equal(t, "[[inputs.cpu]]\n", got)
+}
+
+func TestMarshalRejectsUnsupportedArrayOfTablesElement(t *testing.T) {
+	d := Descriptor{
+		Name:    "cpu",
+		Enabled: true,
+		Config: map[string]interface{}{
+			"object": []interface{}{
+				map[string]interface{}{"ok": true},
+				"not-a-table",
+			},
+		},
+	}
+
+	_, err := Marshal(d)
+	require.Error(t, err)
+}